@@ -1,16 +1,20 @@
 const NpmDependencyResolver = require('./npm')
 const RubyGemsDependencyResolver = require('./rubygems')
+const { abortError } = require('./util/abort')
 
 class RegistryResolver {
-  constructor ({ epsilon, log }) {
+  constructor ({ epsilon, log, concurrency, rateLimit, rateLimitBurst, dependencyTypes, pacoteOptions, rewriteName, cache }) {
     this.log = log
     this.epsilon = epsilon
+    // optional { get(key), set(key, deps) } store (sync or async) consulted before each
+    // registry call, so dependency lists can be reused across computations
+    this.cache = cache
     this.registries = {
       javascript: {
-        npm: new NpmDependencyResolver({ log: this.log })
+        npm: new NpmDependencyResolver({ log: this.log, concurrency, rateLimit, rateLimitBurst, dependencyTypes, pacoteOptions, rewriteName })
       },
       ruby: {
-        rubygems: new RubyGemsDependencyResolver({ log: this.log })
+        rubygems: new RubyGemsDependencyResolver({ log: this.log, concurrency, rateLimit, rateLimitBurst, dependencyTypes })
       }
     }
   }
@@ -87,8 +91,9 @@ class RegistryResolver {
 
   // Given a supported language+registry, this function will use the configured
   // dependency resolver(s) to create a weighted map of all the dependencies of the
-  // passed in "top level packages".
-  async computePackageWeight ({ topLevelPackages, language, registry, noCompList }) {
+  // passed in "top level packages". An optional AbortSignal stops the computation
+  // early; no further registry calls are started once it is aborted.
+  async computePackageWeight ({ topLevelPackages, language, registry, noCompList, signal }) {
     const pkgReg = this.getSupportedRegistry({ registry, language })
     if (!pkgReg) {
       throw new Error('unsupported registry')
@@ -104,17 +109,78 @@ class RegistryResolver {
     const epsilon = this.epsilon
     // this is a map of package => their combined weight
     const packageWeightMap = new Map()
-    // this is a map of package@version => [dep@version, ...]
+    // this is a map of package@version => Promise<[dep@version, ...]> as reported by the registry;
+    // the pending lookup is stored so that concurrent requests for a spec share one registry call
+    const fetchedDependencies = new Map()
+    // this is a map of package@version => Promise<[dep@version, ...]> with no-comp leaves removed
     const resolvedPackages = new Map()
 
     let cacheHits = 0
     let networkCalls = 0
     let noCompPkgs = 0
 
+    // the caller-supplied cache is keyed by registry too, since the same store may be shared
+    const lookupDependencies = async (pkgSpec) => {
+      const key = `${registry}:${pkgSpec}`
+      if (this.cache) {
+        const cached = await this.cache.get(key)
+        if (cached != null) {
+          cacheHits++
+          return cached
+        }
+      }
+      networkCalls++
+      const deps = await pkgReg.getDependencies(pkgSpec, { signal })
+      // an aborted call comes back empty, which isn't worth remembering
+      if (this.cache && !(signal && signal.aborted)) {
+        await this.cache.set(key, deps)
+      }
+      return deps
+    }
+
+    const fetchDependencies = (pkgSpec) => {
+      const pkgId = pkgSpec.toString()
+      if (fetchedDependencies.has(pkgId)) {
+        cacheHits++
+        return fetchedDependencies.get(pkgId)
+      }
+      const pending = lookupDependencies(pkgSpec)
+      fetchedDependencies.set(pkgId, pending)
+      return pending
+    }
+
+    const resolveDependencies = async (pkgSpec) => {
+      const deps = await fetchDependencies(pkgSpec)
+
+      const noCompDeps = deps.filter((depPkgSpec) => _noCompList.has(depPkgSpec.name))
+
+      // any dependencies of this package that are marked as no-comp that have no dependencies themselves
+      // should not be counted in the revenue split; if they have dependencies of their own, that revenue can
+      // flow down to their children. this handles everything except the case where a no comp package depends
+      // soley on no-comp packages.
+      const noCompDepsWithNoDeps = (await Promise.all(noCompDeps.map(async (depPkgSpec) => {
+        const grandDeps = await fetchDependencies(depPkgSpec)
+        return { depPkgSpec, grandDeps }
+      }))).filter(({ grandDeps }) => grandDeps.length === 0).map(({ depPkgSpec }) => depPkgSpec)
+
+      noCompPkgs += noCompDepsWithNoDeps.length
+
+      // remove no comp deps that have no deps from this package's dep list
+      return deps.filter((dep) => !noCompDepsWithNoDeps.some(noCompDep => noCompDep.name === dep.name))
+    }
+
     this.log.info(`Starting package weight computation with ${topLevelPackages.length} top level packages; epsilon: ${epsilon}`)
-    const queue = [{ packages: topLevelPackages, weight: 1 / (topLevelPackages.length || 1) }]
+    // passedThrough holds the no-comp packages that have handed this weight along without
+    // reducing it (see below); it is reset whenever the weight is actually split
+    const queue = [{ packages: topLevelPackages, weight: 1 / (topLevelPackages.length || 1), passedThrough: new Set() }]
     while (queue.length) {
-      const { packages, weight } = queue.pop()
+      // the registries also check the signal as each call leaves their queue, so an abort
+      // mid-layer drops the calls that are still waiting on the concurrency limit
+      if (signal && signal.aborted) {
+        this.log.info(`Aborted package weight; cache hits: ${cacheHits}; network calls: ${networkCalls}; no comp pkgs: ${noCompPkgs}`)
+        throw abortError()
+      }
+      const { packages, weight, passedThrough } = queue.pop()
 
       await Promise.all(packages.map(async (pkg) => {
         let pkgSpec
@@ -133,42 +199,12 @@ class RegistryResolver {
         }
         const pkgId = pkgSpec.toString()
 
-        let deps
         if (resolvedPackages.has(pkgId)) {
-          deps = resolvedPackages.get(pkgId)
           cacheHits++
         } else {
-          deps = await pkgReg.getDependencies(pkgSpec)
-          networkCalls++
-
-          const noCompDeps = deps.filter((depPkgSpec) => _noCompList.has(depPkgSpec.name))
-
-          // any dependencies of this package that are marked as no-comp that have no dependencies themselves
-          // should not be counted in the revenue split; if they have dependencies of their own, that revenue can
-          // flow down to their children. this handles everything except the case where a no comp package depends
-          // soley on no-comp packages.
-          const noCompDepsWithNoDeps = (await Promise.all(noCompDeps.map(async (depPkgSpec) => {
-            let grandDeps
-            const depPkgId = depPkgSpec.toString()
-            if (resolvedPackages.has(depPkgId)) {
-              cacheHits++
-              grandDeps = resolvedPackages.get(depPkgId)
-            } else {
-              grandDeps = await pkgReg.getDependencies(depPkgSpec)
-              resolvedPackages.set(depPkgId, grandDeps)
-              networkCalls++
-            }
-
-            return { depPkgSpec, grandDeps }
-          }))).filter(({ grandDeps }) => grandDeps.length === 0).map(({ depPkgSpec }) => depPkgSpec)
-
-          noCompPkgs += noCompDepsWithNoDeps.length
-
-          // remove no comp deps that have no deps from this package's dep list
-          deps = deps.filter((dep) => !noCompDepsWithNoDeps.some(noCompDep => noCompDep.name === dep.name))
-
-          resolvedPackages.set(pkgId, deps)
+          resolvedPackages.set(pkgId, resolveDependencies(pkgSpec))
         }
+        const deps = await resolvedPackages.get(pkgId)
 
         let splitWeight
         if (_noCompList.has(pkgSpec.name)) {
@@ -179,6 +215,15 @@ class RegistryResolver {
           if (splitWeight < epsilon) {
             return
           }
+          if (splitWeight === weight) {
+            // the weight is passing through undiminished; if this package already passed it along,
+            // we're in a cycle of no-comp packages and the weight would circulate forever
+            if (passedThrough.has(pkgId)) {
+              return
+            }
+            queue.push({ packages: deps, weight, passedThrough: new Set(passedThrough).add(pkgId) })
+            return
+          }
         } else {
           // each package splits the weight with their dependencies evenly
           // deps.length == # of dependencies; +1 == self
@@ -190,7 +235,7 @@ class RegistryResolver {
           packageWeightMap.set(pkgSpec.name, (packageWeightMap.get(pkgSpec.name) || 0) + splitWeight)
         }
 
-        queue.push({ packages: deps, weight: splitWeight })
+        queue.push({ packages: deps, weight: splitWeight, passedThrough: new Set() })
       }))
     }
 
@@ -1,13 +1,33 @@
 const pacote = require('pacote')
 const npa = require('npm-package-arg')
 const limit = require('call-limit')
+const { getMaxRunning } = require('../util/concurrency')
+const { getDependencyTypes } = require('../util/dependency-types')
+const { throwIfAborted } = require('../util/abort')
+const { createRateLimiter } = require('../util/rate-limit')
 
 class NpmDependencyResolver {
-  constructor ({ log }) {
+  constructor ({ log, concurrency, rateLimit, rateLimitBurst, dependencyTypes, pacoteOptions, rewriteName }) {
     this.log = log
+    // optional (name) => name hook applied once to every package name as it is parsed
+    // (see getSpec), e.g. to follow packages that are mirrored under a different scope
+    this.rewriteName = rewriteName
+    this.dependencyTypes = getDependencyTypes(dependencyTypes)
+    // passed through to pacote on every manifest request, e.g. to point at a
+    // private mirror: { registry, '//mirror.example.com/:_authToken': token, '@scope:registry': url }
+    this.pacoteOptions = pacoteOptions || {}
 
-    // allow 30 concurrent calls to npm registry for package manifests
-    this.getManifest = limit.promise(pacote.manifest, 30)
+    // keep manifest requests under rateLimit per second, on top of the concurrency limit
+    this.waitForRateLimit = createRateLimiter(rateLimit, rateLimitBurst)
+
+    // limit concurrent calls to npm registry for package manifests; a call still waiting
+    // on the limit when its signal is aborted is dropped instead of being sent. pacote has
+    // no way to cancel a request, so one already in flight is left to settle
+    this.getManifest = limit.promise(async (spec, opts, signal) => {
+      await this.waitForRateLimit(signal)
+      throwIfAborted(signal)
+      return pacote.manifest(spec, opts)
+    }, getMaxRunning(concurrency))
   }
 
   // a regex-type string list that represents the search pattern
@@ -51,28 +71,44 @@ class NpmDependencyResolver {
   }
 
   // parse a written package like `sodium-native` into what it means to the registry
-  // e.g. sodium-native@latest
+  // e.g. sodium-native@latest; specs that were already parsed (e.g. the output of
+  // getDependencies) are returned as-is so the rewriter only ever sees a name once
   getSpec (pkg) {
-    return npa(pkg)
+    if (typeof pkg === 'object') return pkg
+    return this.applyRewrite(this.unwrapAlias(npa(pkg)))
+  }
+
+  // an alias like `my-lodash@npm:lodash@^4` is installed under the local name
+  // `my-lodash`, but the package actually being depended on is `lodash@^4`
+  unwrapAlias (spec) {
+    return spec.type === 'alias' ? spec.subSpec : spec
+  }
+
+  // swap in the rewritten name (if any) while keeping the requested range/tag
+  applyRewrite (spec) {
+    if (!this.rewriteName || !spec.registry) return spec
+    const name = this.rewriteName(spec.name)
+    return name === spec.name ? spec : npa.resolve(name, spec.rawSpec)
   }
 
   // returns a list of dependency specs: [ { dep1 }, { dep2 }, ...]
   // pkg is some npa.Result
   // ref: https://github.com/DefinitelyTyped/DefinitelyTyped/blob/5344bfc80508c53a23dae37b860fb0c905ff7b24/types/npm-package-arg/index.d.ts#L25
-  async getDependencies (pkg) {
+  async getDependencies (pkg, { signal } = {}) {
     if (!pkg.registry) {
       // this package doesn't live on the NPM registry, so we can't get the deps
       return []
     }
     let dependencies = []
     try {
-      const manifest = await this.resolve(pkg)
+      const manifest = await this.resolve(pkg, { signal })
       // map { js-deep-equals: 1.0.0 } to [{ name: js-deep-equals, rawSpec: 1.0.0, etc }]
       // from npm-package-arg result (see above gh url)
-      dependencies = Object.keys(manifest.dependencies || {})
+      const ranges = this.getDependencyRanges(manifest)
+      dependencies = [...ranges.keys()]
         .map(name => {
           try {
-            return npa.resolve(name, manifest.dependencies[name])
+            return this.applyRewrite(this.unwrapAlias(npa.resolve(name, ranges.get(name))))
           } catch (e) {
             this.log.warn(`unable to resolve package name ${name}`, e)
             return null
@@ -85,6 +121,22 @@ class NpmDependencyResolver {
     return dependencies
   }
 
+  // returns a Map of dep name => range for each of the configured dependency types.
+  // published manifests merge optionalDependencies into dependencies, so optional
+  // deps are separated back out unless optionalDependencies was asked for
+  getDependencyRanges (manifest) {
+    const optionalDeps = manifest.optionalDependencies || {}
+    const ranges = new Map()
+    for (const type of this.dependencyTypes) {
+      const deps = manifest[type] || {}
+      for (const name in deps) {
+        if (type === 'dependencies' && name in optionalDeps) continue
+        if (!ranges.has(name)) ranges.set(name, deps[name])
+      }
+    }
+    return ranges
+  }
+
   // given standard@latest return e.g. standard@13.1.0
   async resolveToSpec (pkg) {
     const manifest = await this.resolve(pkg)
@@ -96,14 +148,17 @@ class NpmDependencyResolver {
   }
 
   // resolve a package to its manifest on the registry
-  async resolve (pkg) {
+  async resolve (pkg, { signal } = {}) {
     try {
-      const manifest = await this.getManifest(npa(pkg), {
+      const manifest = await this.getManifest(this.getSpec(pkg), {
+        ...this.pacoteOptions,
         fullMetadata: false // we only need deps
-      })
+      }, signal)
       return manifest
     } catch (e) {
-      this.log.warn(`unable to get manifest for pkg ${pkg}`, e)
+      if (e.name !== 'AbortError') {
+        this.log.warn(`unable to get manifest for pkg ${pkg}`, e)
+      }
       return {}
     }
   }
@@ -1,3 +1,4 @@
+/* global AbortController */
 const test = require('ava')
 const sinon = require('sinon')
 const limit = require('call-limit')
@@ -53,6 +54,112 @@ test('getSpec | calls npa', (t) => {
   t.deepEqual(t.context.npm.getSpec('js-deep-equals'), npa('js-deep-equals'))
 })
 
+test('getSpec | unwraps npm aliases to the real package', (t) => {
+  const spec = t.context.npm.getSpec('my-lodash@npm:lodash@^4')
+  t.is(spec.name, 'lodash')
+  t.is(spec.toString(), 'lodash@^4')
+
+  const scoped = t.context.npm.getSpec('my-logger@npm:@acme/logger@1.0.0')
+  t.is(scoped.name, '@acme/logger')
+})
+
+test('getDependencies | unwraps aliased dependencies to the real package', async (t) => {
+  t.context.npm.getManifest.returns({
+    name: 'web-app-thing',
+    version: '1.0.0',
+    dependencies: { 'my-lodash': 'npm:lodash@^4' }
+  })
+  const deps = await t.context.npm.getDependencies(npa('web-app-thing@1.0.0'))
+  t.deepEqual(deps, [npa.resolve('lodash', '^4')])
+})
+
+test('resolve | passes pacote options to the registry', async (t) => {
+  const pacoteOptions = {
+    registry: 'https://npm.example.com/',
+    '//npm.example.com/:_authToken': 'secret',
+    '@acme:registry': 'https://acme.example.com/'
+  }
+  const npm = new NpmDependencyResolver({ log: t.context.log, pacoteOptions })
+  npm.getManifest = sinon.stub().resolves({ name: 'js-deep-equals', version: '2.1.1' })
+
+  await npm.resolve('js-deep-equals@2.1.1')
+
+  t.deepEqual(npm.getManifest.lastCall.args[0], npa('js-deep-equals@2.1.1'))
+  t.deepEqual(npm.getManifest.lastCall.args[1], { ...pacoteOptions, fullMetadata: false })
+})
+
+test('getDependencies | passes the signal to the registry call', async (t) => {
+  const { npm } = t.context
+  const { signal } = new AbortController()
+  npm.getManifest.resolves({ dependencies: {} })
+
+  await npm.getDependencies(npa('js-deep-equals@2.1.1'), { signal })
+
+  t.is(npm.getManifest.lastCall.args[2], signal)
+})
+
+test('resolve | an aborted call is not reported as a failure', async (t) => {
+  const { npm } = t.context
+  const err = new Error('package weight computation aborted')
+  err.name = 'AbortError'
+  npm.getManifest.rejects(err)
+
+  t.deepEqual(await npm.resolve('js-deep-equals@2.1.1'), {})
+  t.true(npm.log.warn.notCalled)
+})
+
+test('resolve | defaults to no extra pacote options', async (t) => {
+  t.context.npm.getManifest.resolves({ name: 'js-deep-equals', version: '2.1.1' })
+  await t.context.npm.resolve('js-deep-equals@2.1.1')
+  t.deepEqual(t.context.npm.getManifest.lastCall.args[1], { fullMetadata: false })
+})
+
+test('getSpec | applies the name rewriter', (t) => {
+  const npm = new NpmDependencyResolver({
+    log: t.context.log,
+    rewriteName: (name) => name.replace(/^@old\//, '@new/')
+  })
+  t.is(npm.getSpec('@old/foo@^1.2.0').toString(), '@new/foo@^1.2.0')
+  t.is(npm.getSpec('@old/foo').toString(), '@new/foo@latest')
+  t.is(npm.getSpec('bar@1.0.0').toString(), 'bar@1.0.0')
+})
+
+test('getDependencies | applies the name rewriter to dependencies', async (t) => {
+  const npm = new NpmDependencyResolver({
+    log: t.context.log,
+    rewriteName: (name) => name.replace(/^@old\//, '@new/')
+  })
+  npm.getManifest = sinon.stub().returns({
+    name: 'web-app-thing',
+    version: '1.0.0',
+    dependencies: { '@old/foo': '^1.2.0', bar: '1.0.0' }
+  })
+  const deps = await npm.getDependencies(npa('web-app-thing@1.0.0'))
+  t.deepEqual(deps.map(dep => dep.toString()), ['@new/foo@^1.2.0', 'bar@1.0.0'])
+})
+
+test('getSpec | applies a non-idempotent rewriter only once', async (t) => {
+  const npm = new NpmDependencyResolver({ log: t.context.log, rewriteName: (name) => `@corp/${name}` })
+  npm.getManifest = sinon.stub().returns({ name: '@corp/web-app-thing', version: '1.0.0', dependencies: { foo: '^1.2.0' } })
+
+  const spec = npm.getSpec('web-app-thing@1.0.0')
+  t.is(spec.toString(), '@corp/web-app-thing@1.0.0')
+  t.is(npm.getSpec(spec), spec)
+
+  const deps = await npm.getDependencies(spec)
+  t.deepEqual(deps.map(dep => dep.toString()), ['@corp/foo@^1.2.0'])
+  t.is(npm.getSpec(deps[0]), deps[0])
+  t.is(npm.getManifest.lastCall.args[0], spec)
+})
+
+test('resolveToSpec | applies the name rewriter', async (t) => {
+  const npm = new NpmDependencyResolver({ log: t.context.log, rewriteName: (name) => `mirror-${name}` })
+  npm.getManifest = sinon.stub().resolves({ name: 'mirror-standard', version: '13.1.0' })
+
+  t.is(await npm.resolveToSpec('standard@latest'), 'mirror-standard@13.1.0')
+  t.is(npm.getManifest.lastCall.args[0].toString(), 'mirror-standard@latest')
+})
+
 test('getDependencies | returns dependencies of pkg from registry', async (t) => {
   t.context.npm.getManifest.returns({
     name: 'js-deep-equals',
@@ -71,6 +178,41 @@ test('getDependencies | returns dependencies of pkg from registry', async (t) =>
   t.deepEqual(deps, [npa.resolve('murmurhash', '0.0.2')])
 })
 
+test('getDependencies | follows only runtime dependencies by default', async (t) => {
+  // published manifests list optional deps under both dependencies and optionalDependencies
+  t.context.npm.getManifest.returns({
+    name: 'web-app-thing',
+    version: '1.0.0',
+    dependencies: { murmurhash: '0.0.2', fsevents: '^2.0.0' },
+    optionalDependencies: { fsevents: '^2.0.0' },
+    devDependencies: { ava: '^3.0.0' },
+    peerDependencies: { react: '^16.0.0' }
+  })
+  const deps = await t.context.npm.getDependencies(npa('web-app-thing@1.0.0'))
+  t.deepEqual(deps, [npa.resolve('murmurhash', '0.0.2')])
+})
+
+test('getDependencies | follows the requested dependency types', async (t) => {
+  const npm = new NpmDependencyResolver({
+    log: t.context.log,
+    dependencyTypes: ['dependencies', 'optionalDependencies', 'devDependencies']
+  })
+  npm.getManifest = sinon.stub().returns({
+    name: 'web-app-thing',
+    version: '1.0.0',
+    dependencies: { murmurhash: '0.0.2', fsevents: '^2.0.0' },
+    optionalDependencies: { fsevents: '^2.0.0' },
+    devDependencies: { ava: '^3.0.0' },
+    peerDependencies: { react: '^16.0.0' }
+  })
+  const deps = await npm.getDependencies(npa('web-app-thing@1.0.0'))
+  t.deepEqual(deps, [
+    npa.resolve('murmurhash', '0.0.2'),
+    npa.resolve('fsevents', '^2.0.0'),
+    npa.resolve('ava', '^3.0.0')
+  ])
+})
+
 test('getDependencies | a pkg that is not on the registry', async (t) => {
   const deps = await t.context.npm.getDependencies({ name: 'blah' })
   t.deepEqual(deps, [])
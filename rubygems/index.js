@@ -1,11 +1,37 @@
 const got = require('got')
 const { compare: compareVersions } = require('@snyk/ruby-semver')
 const limit = require('call-limit')
+const { getMaxRunning } = require('../util/concurrency')
+const { getDependencyTypes } = require('../util/dependency-types')
+const { throwIfAborted } = require('../util/abort')
+const { createRateLimiter } = require('../util/rate-limit')
+
+// rubygems.org groups a gem's dependencies as runtime or development; the other
+// dependency types have no RubyGems equivalent
+const DEPENDENCY_GROUPS = {
+  dependencies: 'runtime',
+  devDependencies: 'development'
+}
 
 class RubyGemsDependencyResolver {
-  constructor ({ log }) {
+  constructor ({ log, concurrency, rateLimit, rateLimitBurst, dependencyTypes }) {
     this.log = log
-    this.got = limit.promise(got, 30)
+    this.dependencyGroups = new Set([...getDependencyTypes(dependencyTypes)]
+      .map(type => DEPENDENCY_GROUPS[type])
+      .filter(group => group))
+    // keep requests to rubygems.org under rateLimit per second, on top of the concurrency limit
+    this.waitForRateLimit = createRateLimiter(rateLimit, rateLimitBurst)
+    // limit concurrent calls to rubygems.org; a call still waiting on the limit when its
+    // signal is aborted is dropped instead of being sent, and one in flight is cancelled
+    this.got = limit.promise(async (url, options, signal) => {
+      await this.waitForRateLimit(signal)
+      throwIfAborted(signal)
+      const request = got(url, options)
+      if (!signal) return request
+      const cancel = () => request.cancel()
+      signal.addEventListener('abort', cancel)
+      return request.finally(() => signal.removeEventListener('abort', cancel))
+    }, getMaxRunning(concurrency))
     this.versionsCache = new Map()
   }
 
@@ -106,28 +132,31 @@ class RubyGemsDependencyResolver {
   // To list versions - hit https://rubygems.org/api/v1/versions/[gem name].json
   // To get deps of specific version - hit https://rubygems.org/api/v2/rubygems/[gem name]/versions/[version].json
   // to get latest version deps - hit https://rubygems.org/api/v1/gems/[gem name].json
-  async getDependencies (pkgSpec) {
+  async getDependencies (pkgSpec, { signal } = {}) {
     let name
     let version
     let dependencies
 
     try {
-      const resolved = await this.resolve(pkgSpec)
+      const resolved = await this.resolve(pkgSpec, { signal })
       name = resolved.name
       version = resolved.version
 
       const options = { responseType: 'json' }
       const endpoint = version ? `https://rubygems.org/api/v2/rubygems/${name}/versions/${version}.json` : `https://rubygems.org/api/v1/gems/${name}.json`
-      const { body } = await this.got(endpoint, options)
+      const { body } = await this.got(endpoint, options, signal)
       dependencies = body.dependencies
     } catch (e) {
-      this.log.error(`${e}, ${name}, ${version}`)
+      if (e.name !== 'AbortError') {
+        this.log.error(`${e}, ${name}, ${version}`)
+      }
       // unable to resolve the given spec; no way to get the deps for this input
       return []
     }
 
-    // Response from rubygems will include multiple "dependencies", most commonly "development" and "runtime"
-    const dependencyKeys = Object.keys(dependencies)
+    // Response from rubygems will include multiple "dependencies", most commonly "development" and "runtime";
+    // only the groups for the configured dependency types are followed
+    const dependencyKeys = Object.keys(dependencies).filter(key => this.dependencyGroups.has(key))
     const depRequirements = dependencyKeys.reduce((allDeps, key) => {
       // For each depdency group, compile a complete list of deps
       const runtime = dependencies[key]
@@ -169,7 +198,7 @@ class RubyGemsDependencyResolver {
   // input: output of getSpec
   // resolves the most suitable version to freeze given <name><operator><version>
   // for example: rubocop >= 3.0.0 would fetch all versions available, and select the highest version
-  async resolve (pkgSpec) {
+  async resolve (pkgSpec, { signal } = {}) {
     const { name, operator, versionSpec: version } = pkgSpec
 
     // If operator is =, return name and version UNLESS version is latest, in which case we need to resolve
@@ -182,7 +211,7 @@ class RubyGemsDependencyResolver {
       // Fetch all tags for a package from https://rubygems.org/api/v1/versions/[gem name].json .
       // response will be an array of releases with a "number" key
       const options = { responseType: 'json' }
-      const { body } = await this.got(`https://rubygems.org/api/v1/versions/${name}.json`, options)
+      const { body } = await this.got(`https://rubygems.org/api/v1/versions/${name}.json`, options, signal)
 
       // Grab releases and sort them greatest to least
       const releasesRes = body.map((rel) => rel.number)
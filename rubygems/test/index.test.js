@@ -1,5 +1,7 @@
+/* global AbortController */
 const test = require('ava')
 const sinon = require('sinon')
+const limit = require('call-limit')
 const RubyGemsDependencyResolver = require('../')
 
 test.beforeEach((t) => {
@@ -8,6 +10,45 @@ test.beforeEach((t) => {
   t.context.rubygems.got = sinon.stub()
 })
 
+test('constructor | limits concurrent calls to rubygems.org', (t) => {
+  sinon.stub(limit, 'promise')
+  try {
+    new RubyGemsDependencyResolver({ log: t.context.log }) // eslint-disable-line no-new
+    t.is(typeof limit.promise.lastCall.args[0], 'function')
+    t.is(limit.promise.lastCall.args[1], 30)
+
+    new RubyGemsDependencyResolver({ log: t.context.log, concurrency: 5 }) // eslint-disable-line no-new
+    t.is(limit.promise.lastCall.args[1], 5)
+  } finally {
+    limit.promise.restore()
+  }
+})
+
+test('constructor | drops queued requests once aborted', async (t) => {
+  sinon.stub(limit, 'promise')
+  try {
+    new RubyGemsDependencyResolver({ log: t.context.log }) // eslint-disable-line no-new
+    const request = limit.promise.lastCall.args[0]
+    const controller = new AbortController()
+    controller.abort()
+    await t.throwsAsync(async () => request('https://rubygems.org/api/v1/gems/rails.json', {}, controller.signal), { name: 'AbortError' })
+  } finally {
+    limit.promise.restore()
+  }
+})
+
+test('getDependencies | passes the signal to each request', async (t) => {
+  const { rubygems } = t.context
+  const { signal } = new AbortController()
+  rubygems.got.onFirstCall().resolves({ body: [{ number: '6.0.0' }] })
+  rubygems.got.onSecondCall().resolves({ body: { dependencies: { runtime: [] } } })
+
+  await rubygems.getDependencies({ name: 'rails', operator: '=', versionSpec: 'latest' }, { signal })
+
+  t.is(rubygems.got.getCall(0).args[2], signal)
+  t.is(rubygems.got.getCall(1).args[2], signal)
+})
+
 test('getManifestPatterns', (t) => {
   t.deepEqual(t.context.rubygems.getManifestPatterns(), ['Gemfile'])
 })
@@ -121,13 +162,13 @@ test('getDependencies | returns "latests" dependencies of pkg from registry', as
   t.context.rubygems.got.returns({
     body: {
       dependencies: {
-        development: [
+        development: [],
+        runtime: [
           {
             name: 'actionmailer',
             requirements: '= 3.0.18'
           }
-        ],
-        runtime: []
+        ]
       }
     }
   })
@@ -136,6 +177,67 @@ test('getDependencies | returns "latests" dependencies of pkg from registry', as
   t.deepEqual(deps[0].toString(), 'actionmailer@=3.0.18')
 })
 
+test('getDependencies | excludes development dependencies by default', async (t) => {
+  t.context.rubygems.resolve = sinon.stub().resolves({
+    name: 'vscodium',
+    version: '1.0.0'
+  })
+  t.context.rubygems.got.returns({
+    body: {
+      dependencies: {
+        development: [
+          {
+            name: 'rspec',
+            requirements: '~> 3.0'
+          }
+        ],
+        runtime: [
+          {
+            name: 'actionmailer',
+            requirements: '= 3.0.18'
+          }
+        ]
+      }
+    }
+  })
+  const pkg = t.context.rubygems.getSpec("gem 'rubocop'")
+  const deps = await t.context.rubygems.getDependencies(pkg)
+  t.deepEqual(deps.map(dep => dep.toString()), ['actionmailer@=3.0.18'])
+})
+
+test('getDependencies | includes development dependencies when requested', async (t) => {
+  const rubygems = new RubyGemsDependencyResolver({
+    log: t.context.log,
+    dependencyTypes: ['dependencies', 'devDependencies']
+  })
+  rubygems.got = sinon.stub()
+  rubygems.resolve = sinon.stub().resolves({
+    name: 'vscodium',
+    version: '1.0.0'
+  })
+  rubygems.got.returns({
+    body: {
+      dependencies: {
+        development: [
+          {
+            name: 'rspec',
+            requirements: '~> 3.0'
+          }
+        ],
+        runtime: [
+          {
+            name: 'actionmailer',
+            requirements: '= 3.0.18'
+          }
+        ]
+      }
+    }
+  })
+  const pkg = rubygems.getSpec("gem 'rubocop'")
+  const deps = await rubygems.getDependencies(pkg)
+  t.deepEqual(deps.map(dep => dep.toString()), ['rspec@~>3.0', 'actionmailer@=3.0.18'])
+})
+
 test('resolve | return name and version if operator isn\'t there', async (t) => {
   const pkg = t.context.rubygems.getSpec("gem 'rubocop', '3.1.1'")
   const res = await t.context.rubygems.resolve(pkg)
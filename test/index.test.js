@@ -1,6 +1,9 @@
+/* global AbortController */
 const test = require('ava')
 const sinon = require('sinon')
 const npa = require('npm-package-arg')
+const pacote = require('pacote')
+const limit = require('call-limit')
 const RegistryResolver = require('../')
 
 test.beforeEach((t) => {
@@ -8,6 +11,111 @@ test.beforeEach((t) => {
   t.context.resolver = new RegistryResolver({ log })
 })
 
+test('constructor | passes concurrency to each registry', (t) => {
+  sinon.stub(limit, 'promise')
+  try {
+    new RegistryResolver({ log: {}, concurrency: 4 }) // eslint-disable-line no-new
+    t.is(limit.promise.callCount, 2)
+    t.is(limit.promise.getCall(0).args[1], 4)
+    t.is(limit.promise.getCall(1).args[1], 4)
+  } finally {
+    limit.promise.restore()
+  }
+})
+
+test('constructor | gives each registry its own rate limiter', (t) => {
+  const resolver = new RegistryResolver({ log: {}, rateLimit: 10, rateLimitBurst: 2 })
+  const { npm } = resolver.registries.javascript
+  const { rubygems } = resolver.registries.ruby
+  t.is(typeof npm.waitForRateLimit, 'function')
+  t.is(typeof rubygems.waitForRateLimit, 'function')
+  t.true(npm.waitForRateLimit !== rubygems.waitForRateLimit)
+  t.throws(() => new RegistryResolver({ log: {}, rateLimit: 'fast' }), { message: 'rateLimit must be a number; got fast' })
+})
+
+test('constructor | passes dependency types to each registry', (t) => {
+  const resolver = new RegistryResolver({ log: {}, dependencyTypes: ['dependencies', 'devDependencies'] })
+  t.deepEqual(resolver.registries.javascript.npm.dependencyTypes, new Set(['dependencies', 'devDependencies']))
+  t.deepEqual(resolver.registries.ruby.rubygems.dependencyGroups, new Set(['runtime', 'development']))
+})
+
+test('constructor | passes pacote options to npm', (t) => {
+  const pacoteOptions = { registry: 'https://npm.example.com/' }
+  const resolver = new RegistryResolver({ log: {}, pacoteOptions })
+  t.is(resolver.registries.javascript.npm.pacoteOptions, pacoteOptions)
+})
+
+test.serial('computePackageWeight | npm | never exceeds the concurrency limit', async (t) => {
+  // a fake registry whose responses are held until the test releases them,
+  // so we can observe how many manifest requests are in flight at once
+  let inFlight = 0
+  let maxInFlight = 0
+  const pending = []
+  sinon.stub(pacote, 'manifest').callsFake((spec) => {
+    inFlight++
+    maxInFlight = Math.max(maxInFlight, inFlight)
+    return new Promise((resolve) => pending.push(() => {
+      inFlight--
+      resolve({ name: spec.name, version: '1.0.0', dependencies: {} })
+    }))
+  })
+
+  try {
+    const log = { info: sinon.stub(), warn: sinon.stub(), error: sinon.stub() }
+    const resolver = new RegistryResolver({ log, epsilon: 0.01, concurrency: 2 })
+
+    let settled = false
+    const computation = resolver.computePackageWeight({
+      topLevelPackages: ['a', 'b', 'c', 'd', 'e', 'f'],
+      language: 'javascript',
+      registry: 'npm'
+    }).then((packageWeightMap) => {
+      settled = true
+      return packageWeightMap
+    })
+
+    while (!settled) {
+      await new Promise((resolve) => setImmediate(resolve))
+      t.true(inFlight <= 2)
+      if (pending.length) pending.shift()()
+    }
+
+    t.is(maxInFlight, 2)
+    t.is((await computation).size, 6)
+    t.is(pacote.manifest.callCount, 6)
+  } finally {
+    pacote.manifest.restore()
+  }
+})
+
+test.serial('computePackageWeight | npm | keeps registry calls under the rate limit', async (t) => {
+  const startedAt = []
+  sinon.stub(pacote, 'manifest').callsFake(async (spec) => {
+    startedAt.push(Date.now())
+    return { name: spec.name, version: '1.0.0', dependencies: {} }
+  })
+
+  try {
+    const log = { info: sinon.stub(), warn: sinon.stub(), error: sinon.stub() }
+    const resolver = new RegistryResolver({ log, epsilon: 0.01, concurrency: 0, rateLimit: 20 })
+
+    const packageWeightMap = await resolver.computePackageWeight({
+      topLevelPackages: ['a', 'b', 'c', 'd'],
+      language: 'javascript',
+      registry: 'npm'
+    })
+
+    t.is(packageWeightMap.size, 4)
+    t.is(startedAt.length, 4)
+    // 20 per second is one call every 50ms; allow a little timer slack
+    for (let i = 1; i < startedAt.length; i++) {
+      t.true(startedAt[i] - startedAt[i - 1] >= 45)
+    }
+  } finally {
+    pacote.manifest.restore()
+  }
+})
+
 test('computePackageWeight | unsupported registry', async (t) => {
   const { resolver } = t.context
   await t.throwsAsync(() => resolver.computePackageWeight({
@@ -161,6 +269,263 @@ test('computePackageWeight | npm | defers to cache for no-comp deps', async (t)
   t.false(packageWeightMap.has('react'))
 })
 
+test('computePackageWeight | npm | concurrent lookups of one spec share a registry call', async (t) => {
+  // both top level packages depend on the no-comp react, and are processed in the same batch,
+  // so their lookups of react (and the duplicated top level spec) are in flight at the same time
+  const { resolver } = t.context
+  resolver.registries.javascript.npm.getSpec = npa
+
+  const callCounts = new Map()
+  resolver.registries.javascript.npm.getDependencies = async (pkg) => {
+    callCounts.set(pkg.name, (callCounts.get(pkg.name) || 0) + 1)
+    if (pkg.name === 'js-deep-equals' || pkg.name === 'web-app-thing') {
+      return [npa('react@0.0.0')]
+    }
+    return []
+  }
+  resolver.epsilon = 0.01
+
+  const packageWeightMap = await resolver.computePackageWeight({
+    topLevelPackages: ['js-deep-equals', 'web-app-thing', 'web-app-thing'],
+    language: 'javascript',
+    registry: 'npm',
+    noCompList: new Set(['react'])
+  })
+
+  t.is(callCounts.get('react'), 1)
+  t.is(callCounts.get('web-app-thing'), 1)
+  t.is(packageWeightMap.get('js-deep-equals'), 1 / 3)
+  t.is(packageWeightMap.get('web-app-thing'), 2 / 3)
+  t.false(packageWeightMap.has('react'))
+})
+
+test('computePackageWeight | npm | reuses a caller-supplied cache across computations', async (t) => {
+  const log = { info: sinon.stub(), warn: sinon.stub(), error: sinon.stub() }
+  const cache = new Map()
+  const resolver = new RegistryResolver({ log, epsilon: 0.01, cache })
+  const npm = resolver.registries.javascript.npm
+  npm.getDependencies = sinon.stub().callsFake(async (spec) => {
+    if (spec.name === 'web-app-thing') return [npm.getSpec('lodash@^4')]
+    return []
+  })
+  const args = { topLevelPackages: ['web-app-thing'], language: 'javascript', registry: 'npm' }
+
+  const first = await resolver.computePackageWeight(args)
+  t.is(npm.getDependencies.callCount, 2)
+  t.deepEqual([...cache.keys()], ['npm:web-app-thing@latest', 'npm:lodash@^4'])
+
+  const second = await resolver.computePackageWeight(args)
+  t.is(npm.getDependencies.callCount, 2)
+  t.deepEqual(second, first)
+})
+
+test('computePackageWeight | rubygems | reuses a caller-supplied async cache', async (t) => {
+  const log = { info: sinon.stub(), warn: sinon.stub(), error: sinon.stub() }
+  const store = new Map()
+  const cache = {
+    get: async (key) => store.get(key),
+    set: async (key, deps) => { store.set(key, deps) }
+  }
+  const resolver = new RegistryResolver({ log, epsilon: 0.01, cache })
+  const rubygems = resolver.registries.ruby.rubygems
+  rubygems.getDependencies = sinon.stub().callsFake(async (spec) => {
+    if (spec.name === 'rails') return [rubygems.getSpec("gem 'rack', '= 2.0.0'")]
+    return []
+  })
+  const args = { topLevelPackages: ["gem 'rails', '= 6.0.0'"], language: 'ruby', registry: 'rubygems' }
+
+  const first = await resolver.computePackageWeight(args)
+  t.is(rubygems.getDependencies.callCount, 2)
+  t.true(store.has('rubygems:rails@=6.0.0'))
+
+  const second = await resolver.computePackageWeight(args)
+  t.is(rubygems.getDependencies.callCount, 2)
+  t.deepEqual(second, first)
+})
+
+test('computePackageWeight | npm | breaks cycles between no-comp pkgs', async (t) => {
+  // a and b are both no-comp and depend on each other, so each passes its full weight to the other;
+  // without a cycle break the weight never drops below epsilon and the computation never finishes
+  const { resolver } = t.context
+  resolver.registries.javascript.npm.getSpec = npa
+  resolver.registries.javascript.npm.getDependencies = (pkg) => {
+    if (pkg.name === 'web-app-thing') {
+      return [npa('a@1.0.0')]
+    }
+    if (pkg.name === 'a') {
+      return [npa('b@1.0.0')]
+    }
+    if (pkg.name === 'b') {
+      return [npa('a@1.0.0')]
+    }
+    return []
+  }
+  resolver.epsilon = 0.01
+
+  const packageWeightMap = await resolver.computePackageWeight({
+    topLevelPackages: ['web-app-thing', 'a'],
+    language: 'javascript',
+    registry: 'npm',
+    noCompList: new Set(['a', 'b'])
+  })
+
+  t.is(packageWeightMap.get('web-app-thing'), 0.25)
+  t.false(packageWeightMap.has('a'))
+  t.false(packageWeightMap.has('b'))
+})
+
+test('computePackageWeight | npm | credits aliased deps to the real package', async (t) => {
+  const { resolver } = t.context
+  resolver.registries.javascript.npm.getManifest = (spec) => {
+    if (spec.name === 'web-app-thing') {
+      return { name: 'web-app-thing', version: '1.0.0', dependencies: { 'my-lodash': 'npm:lodash@^4' } }
+    }
+    return { name: spec.name, version: '4.17.21', dependencies: {} }
+  }
+  resolver.epsilon = 0.01
+
+  const packageWeightMap = await resolver.computePackageWeight({
+    topLevelPackages: ['web-app-thing'],
+    language: 'javascript',
+    registry: 'npm'
+  })
+
+  t.is(packageWeightMap.get('web-app-thing'), 0.5)
+  t.is(packageWeightMap.get('lodash'), 0.5)
+  t.false(packageWeightMap.has('my-lodash'))
+})
+
+test('computePackageWeight | npm | fetches and credits rewritten names', async (t) => {
+  const log = { info: sinon.stub(), warn: sinon.stub(), error: sinon.stub() }
+  const resolver = new RegistryResolver({
+    log,
+    epsilon: 0.01,
+    rewriteName: (name) => name.replace(/^@old\//, '@new/')
+  })
+  const fetched = []
+  resolver.registries.javascript.npm.getManifest = (spec) => {
+    fetched.push(spec.name)
+    if (spec.name === 'web-app-thing') {
+      return { name: 'web-app-thing', version: '1.0.0', dependencies: { '@old/foo': '^1.0.0' } }
+    }
+    return { name: spec.name, version: '1.0.0', dependencies: {} }
+  }
+
+  const packageWeightMap = await resolver.computePackageWeight({
+    topLevelPackages: ['web-app-thing'],
+    language: 'javascript',
+    registry: 'npm'
+  })
+
+  t.deepEqual(fetched, ['web-app-thing', '@new/foo'])
+  t.is(packageWeightMap.get('@new/foo'), 0.5)
+  t.false(packageWeightMap.has('@old/foo'))
+})
+
+test('computePackageWeight | npm | rewrites each name exactly once', async (t) => {
+  const log = { info: sinon.stub(), warn: sinon.stub(), error: sinon.stub() }
+  const resolver = new RegistryResolver({ log, epsilon: 0.01, rewriteName: (name) => `mirror-${name}` })
+  const fetched = []
+  resolver.registries.javascript.npm.getManifest = (spec) => {
+    fetched.push(spec.name)
+    if (spec.name === 'mirror-web-app-thing') {
+      return { name: spec.name, version: '1.0.0', dependencies: { foo: '^1.0.0', b: '^1.0.0' } }
+    }
+    if (spec.name === 'mirror-foo') {
+      return { name: spec.name, version: '1.0.0', dependencies: { bar: '^1.0.0' } }
+    }
+    return { name: spec.name, version: '1.0.0', dependencies: {} }
+  }
+
+  const packageWeightMap = await resolver.computePackageWeight({
+    topLevelPackages: ['web-app-thing'],
+    language: 'javascript',
+    registry: 'npm',
+    // the no-comp list is matched against rewritten names
+    noCompList: new Set(['mirror-b'])
+  })
+
+  t.deepEqual(fetched.sort(), ['mirror-b', 'mirror-bar', 'mirror-foo', 'mirror-web-app-thing'])
+  t.deepEqual([...packageWeightMap.keys()].sort(), ['mirror-bar', 'mirror-foo', 'mirror-web-app-thing'])
+  t.is(packageWeightMap.get('mirror-web-app-thing'), 0.5)
+  t.is(packageWeightMap.get('mirror-foo'), 0.25)
+  t.is(packageWeightMap.get('mirror-bar'), 0.25)
+})
+
+test('computePackageWeight | stops when aborted', async (t) => {
+  const { resolver } = t.context
+  const controller = new AbortController()
+  const requested = []
+  resolver.registries.javascript.npm.getSpec = npa
+  resolver.registries.javascript.npm.getDependencies = (pkg) => {
+    requested.push(pkg.name)
+    if (pkg.name === 'js-deep-equals') {
+      // abort once the first layer has been fetched
+      controller.abort()
+      return [npa('murmurhash@0.0.2')]
+    }
+    return []
+  }
+  resolver.epsilon = 0.01
+
+  await t.throwsAsync(() => resolver.computePackageWeight({
+    topLevelPackages: ['js-deep-equals'],
+    language: 'javascript',
+    registry: 'npm',
+    signal: controller.signal
+  }), { name: 'AbortError' })
+
+  t.deepEqual(requested, ['js-deep-equals'])
+})
+
+test.serial('computePackageWeight | npm | queued registry calls are dropped once aborted', async (t) => {
+  const controller = new AbortController()
+  const pending = []
+  sinon.stub(pacote, 'manifest').callsFake((spec) => new Promise((resolve) => pending.push(() => {
+    resolve({ name: spec.name, version: '1.0.0', dependencies: {} })
+  })))
+
+  try {
+    const log = { info: sinon.stub(), warn: sinon.stub(), error: sinon.stub() }
+    const resolver = new RegistryResolver({ log, epsilon: 0.01, concurrency: 1 })
+
+    const computation = resolver.computePackageWeight({
+      topLevelPackages: ['a', 'b', 'c', 'd', 'e'],
+      language: 'javascript',
+      registry: 'npm',
+      signal: controller.signal
+    })
+
+    // abort while the first manifest fetch is in flight and the other four are queued
+    await new Promise((resolve) => setImmediate(resolve))
+    t.is(pacote.manifest.callCount, 1)
+    controller.abort()
+    pending.shift()()
+
+    await t.throwsAsync(() => computation, { name: 'AbortError' })
+    t.is(pacote.manifest.callCount, 1)
+  } finally {
+    pacote.manifest.restore()
+  }
+})
+
+test('computePackageWeight | already aborted signal makes no registry calls', async (t) => {
+  const { resolver } = t.context
+  const controller = new AbortController()
+  controller.abort()
+  resolver.registries.javascript.npm.getSpec = npa
+  resolver.registries.javascript.npm.getDependencies = sinon.stub().returns([])
+
+  await t.throwsAsync(() => resolver.computePackageWeight({
+    topLevelPackages: ['js-deep-equals'],
+    language: 'javascript',
+    registry: 'npm',
+    signal: controller.signal
+  }), { name: 'AbortError' })
+
+  t.true(resolver.registries.javascript.npm.getDependencies.notCalled)
+})
+
 test('computePackageWeight | epsilon stops computation', async (t) => {
   const { resolver } = t.context
   resolver.registries.javascript.npm.getSpec = npa
@@ -0,0 +1,13 @@
+// the error computePackageWeight and the registry resolvers reject with once their signal is aborted
+function abortError () {
+  const err = new Error('package weight computation aborted')
+  err.name = 'AbortError'
+  return err
+}
+
+// throw an AbortError if the (optional) AbortSignal has been aborted
+function throwIfAborted (signal) {
+  if (signal && signal.aborted) throw abortError()
+}
+
+module.exports = { abortError, throwIfAborted }
@@ -0,0 +1,15 @@
+// the number of concurrent registry calls allowed when no concurrency is configured
+const DEFAULT_CONCURRENCY = 30
+
+// translate a user-supplied concurrency option into call-limit's maxRunning;
+// null/undefined uses the default, and zero or negative means unbounded
+function getMaxRunning (concurrency) {
+  if (concurrency == null) return DEFAULT_CONCURRENCY
+  if (!Number.isInteger(concurrency)) {
+    throw new Error(`concurrency must be an integer; got ${concurrency}`)
+  }
+  if (concurrency <= 0) return Infinity
+  return concurrency
+}
+
+module.exports = { DEFAULT_CONCURRENCY, getMaxRunning }
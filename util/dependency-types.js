@@ -0,0 +1,22 @@
+// the kinds of dependency edges a registry resolver can follow, named after
+// the package.json fields; registries map these onto their own groupings
+const DEPENDENCY_TYPES = ['dependencies', 'devDependencies', 'peerDependencies', 'optionalDependencies']
+
+// by default only runtime dependencies are followed, since those are the
+// packages a project actually relies on when it runs
+const DEFAULT_DEPENDENCY_TYPES = ['dependencies']
+
+// translate a user-supplied dependencyTypes option (any iterable) into a Set;
+// null/undefined uses the default
+function getDependencyTypes (dependencyTypes) {
+  if (dependencyTypes == null) return new Set(DEFAULT_DEPENDENCY_TYPES)
+  const types = new Set(dependencyTypes)
+  for (const type of types) {
+    if (!DEPENDENCY_TYPES.includes(type)) {
+      throw new Error(`unsupported dependency type ${type}; expected one of ${DEPENDENCY_TYPES.join(', ')}`)
+    }
+  }
+  return types
+}
+
+module.exports = { DEPENDENCY_TYPES, DEFAULT_DEPENDENCY_TYPES, getDependencyTypes }
@@ -0,0 +1,47 @@
+const { abortError, throwIfAborted } = require('./abort')
+
+// resolves after ms, or rejects with an AbortError as soon as the signal is aborted
+function sleep (ms, signal) {
+  return new Promise((resolve, reject) => {
+    const onAbort = () => {
+      clearTimeout(timer)
+      reject(abortError())
+    }
+    const timer = setTimeout(() => {
+      if (signal) signal.removeEventListener('abort', onAbort)
+      resolve()
+    }, ms)
+    if (signal) signal.addEventListener('abort', onAbort)
+  })
+}
+
+// build a token-bucket limiter allowing `rateLimit` calls per second, with up to `burst`
+// calls let through back to back; null/undefined or zero/negative means unlimited. the
+// returned function resolves once the caller may make its call, and each call reserves
+// its slot up front so concurrent callers are spaced out rather than released together
+function createRateLimiter (rateLimit, burst, { now = Date.now, wait = sleep } = {}) {
+  if (burst == null) burst = 1
+  if (rateLimit != null && (typeof rateLimit !== 'number' || Number.isNaN(rateLimit))) {
+    throw new Error(`rateLimit must be a number; got ${rateLimit}`)
+  }
+  if (!Number.isInteger(burst) || burst < 1) {
+    throw new Error(`rateLimit burst must be a positive integer; got ${burst}`)
+  }
+  if (rateLimit == null || rateLimit <= 0 || rateLimit === Infinity) {
+    return async (signal) => throwIfAborted(signal)
+  }
+
+  const interval = 1000 / rateLimit
+  // the time at which the bucket would be full again if no more calls came in
+  let fullAt = now()
+
+  return async (signal) => {
+    throwIfAborted(signal)
+    const at = now()
+    const delay = Math.max(fullAt, at) - (burst - 1) * interval - at
+    fullAt = Math.max(fullAt, at) + interval
+    if (delay > 0) await wait(delay, signal)
+  }
+}
+
+module.exports = { createRateLimiter }
@@ -0,0 +1,25 @@
+const test = require('ava')
+const { DEFAULT_CONCURRENCY, getMaxRunning } = require('../concurrency')
+
+test('getMaxRunning | defaults when unset', (t) => {
+  t.is(getMaxRunning(), DEFAULT_CONCURRENCY)
+  t.is(getMaxRunning(undefined), DEFAULT_CONCURRENCY)
+  t.is(getMaxRunning(null), DEFAULT_CONCURRENCY)
+})
+
+test('getMaxRunning | positive integers are used as-is', (t) => {
+  t.is(getMaxRunning(1), 1)
+  t.is(getMaxRunning(5), 5)
+})
+
+test('getMaxRunning | zero or negative is unbounded', (t) => {
+  t.is(getMaxRunning(0), Infinity)
+  t.is(getMaxRunning(-1), Infinity)
+})
+
+test('getMaxRunning | rejects non-integers', (t) => {
+  t.throws(() => getMaxRunning(NaN))
+  t.throws(() => getMaxRunning('5'))
+  t.throws(() => getMaxRunning(2.5))
+  t.throws(() => getMaxRunning(Infinity))
+})
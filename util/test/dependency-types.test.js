@@ -0,0 +1,16 @@
+const test = require('ava')
+const { getDependencyTypes } = require('../dependency-types')
+
+test('getDependencyTypes | defaults to runtime dependencies', (t) => {
+  t.deepEqual(getDependencyTypes(), new Set(['dependencies']))
+  t.deepEqual(getDependencyTypes(null), new Set(['dependencies']))
+})
+
+test('getDependencyTypes | accepts any iterable of known types', (t) => {
+  t.deepEqual(getDependencyTypes(['dependencies', 'peerDependencies']), new Set(['dependencies', 'peerDependencies']))
+  t.deepEqual(getDependencyTypes(new Set(['devDependencies'])), new Set(['devDependencies']))
+})
+
+test('getDependencyTypes | rejects unknown types', (t) => {
+  t.throws(() => getDependencyTypes(['runtime']))
+})
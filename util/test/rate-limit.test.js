@@ -0,0 +1,66 @@
+/* global AbortController */
+const test = require('ava')
+const { createRateLimiter } = require('../rate-limit')
+
+// a fake clock: waits are recorded instead of slept, and time only moves when the test says so
+function fakeClock () {
+  const clock = { time: 0, waits: [] }
+  clock.now = () => clock.time
+  clock.wait = async (ms) => { clock.waits.push(ms) }
+  return clock
+}
+
+test('createRateLimiter | unlimited when unset, zero or negative', async (t) => {
+  for (const rateLimit of [undefined, null, 0, -1]) {
+    const clock = fakeClock()
+    const waitForRateLimit = createRateLimiter(rateLimit, undefined, clock)
+    await Promise.all([waitForRateLimit(), waitForRateLimit(), waitForRateLimit()])
+    t.deepEqual(clock.waits, [])
+  }
+})
+
+test('createRateLimiter | spaces concurrent calls at the configured rate', async (t) => {
+  const clock = fakeClock()
+  const waitForRateLimit = createRateLimiter(2, undefined, clock)
+  await Promise.all([waitForRateLimit(), waitForRateLimit(), waitForRateLimit(), waitForRateLimit()])
+  t.deepEqual(clock.waits, [500, 1000, 1500])
+})
+
+test('createRateLimiter | lets a burst through before spacing calls', async (t) => {
+  const clock = fakeClock()
+  const waitForRateLimit = createRateLimiter(2, 3, clock)
+  await Promise.all([waitForRateLimit(), waitForRateLimit(), waitForRateLimit(), waitForRateLimit()])
+  t.deepEqual(clock.waits, [500])
+})
+
+test('createRateLimiter | refills as time passes', async (t) => {
+  const clock = fakeClock()
+  const waitForRateLimit = createRateLimiter(2, 2, clock)
+  await Promise.all([waitForRateLimit(), waitForRateLimit()])
+  clock.time = 250
+  await waitForRateLimit()
+  clock.time = 5000
+  await Promise.all([waitForRateLimit(), waitForRateLimit()])
+  t.deepEqual(clock.waits, [250])
+})
+
+test('createRateLimiter | rejects invalid options', (t) => {
+  t.throws(() => createRateLimiter('5'), { message: 'rateLimit must be a number; got 5' })
+  t.throws(() => createRateLimiter(NaN), { message: 'rateLimit must be a number; got NaN' })
+  t.throws(() => createRateLimiter(5, 0), { message: 'rateLimit burst must be a positive integer; got 0' })
+  t.throws(() => createRateLimiter(5, 1.5), { message: 'rateLimit burst must be a positive integer; got 1.5' })
+})
+
+test('createRateLimiter | stops waiting once aborted', async (t) => {
+  const waitForRateLimit = createRateLimiter(1)
+  const controller = new AbortController()
+  await waitForRateLimit(controller.signal)
+
+  const started = Date.now()
+  const waiting = waitForRateLimit(controller.signal)
+  controller.abort()
+  await t.throwsAsync(() => waiting, { name: 'AbortError' })
+  t.true(Date.now() - started < 500)
+
+  await t.throwsAsync(() => waitForRateLimit(controller.signal), { name: 'AbortError' })
+})